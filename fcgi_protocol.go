@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// FastCGI record types, see the FastCGI spec section 3.3.
+const (
+	fcgiBeginRequest = 1
+	fcgiAbortRequest = 2
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+)
+
+const (
+	fcgiVersion1      = 1
+	fcgiHeaderLen     = 8
+	fcgiRoleResponder = 1
+)
+
+// fcgiHeader is the 8-byte record header shared by every FastCGI record:
+// {version, type, requestID, contentLength, paddingLength, reserved}.
+type fcgiHeader struct {
+	version       byte
+	reqType       byte
+	requestID     uint16
+	contentLength uint16
+	paddingLength byte
+	reserved      byte
+}
+
+func (h fcgiHeader) marshal() []byte {
+	b := make([]byte, fcgiHeaderLen)
+	b[0] = h.version
+	b[1] = h.reqType
+	binary.BigEndian.PutUint16(b[2:4], h.requestID)
+	binary.BigEndian.PutUint16(b[4:6], h.contentLength)
+	b[6] = h.paddingLength
+	b[7] = h.reserved
+
+	return b
+}
+
+func unmarshalFcgiHeader(b []byte) fcgiHeader {
+	return fcgiHeader{
+		version:       b[0],
+		reqType:       b[1],
+		requestID:     binary.BigEndian.Uint16(b[2:4]),
+		contentLength: binary.BigEndian.Uint16(b[4:6]),
+		paddingLength: b[6],
+		reserved:      b[7],
+	}
+}
+
+// fcgiMaxRecordPayload is the largest payload a single record can carry,
+// since contentLength is a 16-bit field (FastCGI spec section 3.3).
+const fcgiMaxRecordPayload = 65535
+
+// fcgiRecord wraps payload in one or more FastCGI records, each padded to
+// a multiple of 8 bytes as recommended (not required) by the spec.
+// Payloads longer than fcgiMaxRecordPayload are split across several
+// records, since contentLength can't represent them in one.
+func fcgiRecord(reqType byte, requestID uint16, payload []byte) []byte {
+	if len(payload) == 0 {
+		return fcgiRecordChunk(reqType, requestID, payload)
+	}
+
+	var out []byte
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > fcgiMaxRecordPayload {
+			n = fcgiMaxRecordPayload
+		}
+
+		out = append(out, fcgiRecordChunk(reqType, requestID, payload[:n])...)
+		payload = payload[n:]
+	}
+
+	return out
+}
+
+// fcgiRecordChunk wraps a single payload, no longer than
+// fcgiMaxRecordPayload, in one FastCGI record.
+func fcgiRecordChunk(reqType byte, requestID uint16, payload []byte) []byte {
+	padding := (8 - len(payload)%8) % 8
+
+	h := fcgiHeader{
+		version:       fcgiVersion1,
+		reqType:       reqType,
+		requestID:     requestID,
+		contentLength: uint16(len(payload)),
+		paddingLength: byte(padding),
+	}
+
+	record := append(h.marshal(), payload...)
+	record = append(record, make([]byte, padding)...)
+
+	return record
+}
+
+// fcgiBeginRequestRecord builds the FCGI_BEGIN_REQUEST record that starts
+// every FastCGI request.
+func fcgiBeginRequestRecord(requestID uint16) []byte {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint16(body[0:2], fcgiRoleResponder)
+	// body[2] = flags, body[3:8] reserved, both left zero (don't keep the connection open)
+
+	return fcgiRecord(fcgiBeginRequest, requestID, body)
+}
+
+// fcgiNameValuePairs encodes name/value pairs using FastCGI's
+// variable-length size prefixes (section 3.4).
+func fcgiNameValuePairs(pairs map[string]string) []byte {
+	var out []byte
+
+	putLen := func(n int) {
+		if n <= 127 {
+			out = append(out, byte(n))
+		} else {
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, uint32(n)|0x80000000)
+			out = append(out, b...)
+		}
+	}
+
+	for name, value := range pairs {
+		putLen(len(name))
+		putLen(len(value))
+		out = append(out, name...)
+		out = append(out, value...)
+	}
+
+	return out
+}
+
+// fcgiParseNameValuePairs decodes the FCGI_PARAMS payload produced by
+// fcgiNameValuePairs.
+func fcgiParseNameValuePairs(b []byte) map[string]string {
+	pairs := make(map[string]string)
+
+	// readLen reports ok=false rather than indexing out of range when b
+	// doesn't hold a full length prefix at i — b comes straight off the
+	// wire (FCGIInput reads it from a unix or TCP connection), so a truncated or
+	// malformed FCGI_PARAMS payload must not panic.
+	readLen := func(i int) (n, size int, ok bool) {
+		if i >= len(b) {
+			return 0, 0, false
+		}
+		if b[i]&0x80 == 0 {
+			return int(b[i]), 1, true
+		}
+		if i+4 > len(b) {
+			return 0, 0, false
+		}
+		return int(binary.BigEndian.Uint32(b[i:i+4]) & 0x7fffffff), 4, true
+	}
+
+	i := 0
+	for i < len(b) {
+		nameLen, n, ok := readLen(i)
+		if !ok {
+			break
+		}
+		i += n
+
+		valueLen, n, ok := readLen(i)
+		if !ok {
+			break
+		}
+		i += n
+
+		if i+nameLen+valueLen > len(b) {
+			break
+		}
+
+		name := string(b[i : i+nameLen])
+		i += nameLen
+		value := string(b[i : i+valueLen])
+		i += valueLen
+
+		pairs[name] = value
+	}
+
+	return pairs
+}
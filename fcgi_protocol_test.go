@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFcgiRecordSplitsOversizedPayload(t *testing.T) {
+	payload := make([]byte, fcgiMaxRecordPayload+100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	record := fcgiRecord(fcgiStdin, 1, payload)
+
+	var got []byte
+	for len(record) > 0 {
+		h := unmarshalFcgiHeader(record[:fcgiHeaderLen])
+		record = record[fcgiHeaderLen:]
+
+		if int(h.contentLength) > fcgiMaxRecordPayload {
+			t.Fatalf("record contentLength %d exceeds the 16-bit max", h.contentLength)
+		}
+
+		got = append(got, record[:h.contentLength]...)
+		record = record[int(h.contentLength)+int(h.paddingLength):]
+	}
+
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("reassembled payload did not round-trip through multiple records")
+	}
+}
+
+func TestFcgiParseNameValuePairsTruncatedPayload(t *testing.T) {
+	// A single byte claiming a 4-byte extended length prefix, but with no
+	// bytes following it: must not panic.
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("fcgiParseNameValuePairs panicked on truncated input: %v", r)
+		}
+	}()
+
+	pairs := fcgiParseNameValuePairs([]byte{0x80})
+	if len(pairs) != 0 {
+		t.Fatalf("expected no pairs decoded from truncated input, got %v", pairs)
+	}
+}
+
+func TestFcgiNameValuePairsRoundTrip(t *testing.T) {
+	in := map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/"}
+
+	out := fcgiParseNameValuePairs(fcgiNameValuePairs(in))
+
+	for k, v := range in {
+		if out[k] != v {
+			t.Fatalf("expected %s=%q, got %q", k, v, out[k])
+		}
+	}
+}
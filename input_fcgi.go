@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+)
+
+// FCGIInputConfig holds the address FCGIInput listens on.
+type FCGIInputConfig struct {
+	address string
+}
+
+// FCGIInput listens for FastCGI requests on a unix or TCP socket,
+// multiplexes records by requestID, decodes FCGI_PARAMS/FCGI_STDIN into a
+// synthesized HTTP/1 request and feeds it into the same replay pipeline
+// TCPMessage.Bytes() produces, so gor can sit in front of a
+// PHP-FPM/Python FCGI tier.
+type FCGIInput struct {
+	address  string
+	listener net.Listener
+	data     chan []byte
+
+	// leftover holds the tail of a synthesized request that didn't fit in
+	// the caller's buffer on the previous Read, so it can be handed back
+	// before pulling the next request off data.
+	leftover []byte
+}
+
+// NewFCGIInput constructor for FCGIInput, accepts a "host:port" address
+// or a path to a unix socket.
+func NewFCGIInput(address string, config *FCGIInputConfig) *FCGIInput {
+	i := &FCGIInput{
+		address: address,
+		data:    make(chan []byte, 100),
+	}
+
+	i.listen(address)
+
+	return i
+}
+
+func (i *FCGIInput) listen(address string) {
+	network := "tcp"
+	if len(address) > 0 && address[0] == '/' {
+		network = "unix"
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal("FCGIInput: can't listen on", address, err)
+	}
+	i.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				Debug("FCGIInput: accept error:", err)
+				return
+			}
+
+			go i.handleConn(conn)
+		}
+	}()
+}
+
+// fcgiRequest accumulates the records belonging to a single requestID
+// until FCGI_PARAMS and FCGI_STDIN have both been terminated.
+type fcgiRequest struct {
+	params    bytes.Buffer
+	stdin     bytes.Buffer
+	paramsEnd bool
+	stdinEnd  bool
+}
+
+func (i *FCGIInput) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	requests := make(map[uint16]*fcgiRequest)
+	var mu sync.Mutex
+
+	header := make([]byte, fcgiHeaderLen)
+
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		h := unmarshalFcgiHeader(header)
+
+		payload := make([]byte, h.contentLength)
+		if h.contentLength > 0 {
+			if _, err := io.ReadFull(conn, payload); err != nil {
+				return
+			}
+		}
+		if h.paddingLength > 0 {
+			io.CopyN(ioutil.Discard, conn, int64(h.paddingLength))
+		}
+
+		mu.Lock()
+		req, ok := requests[h.requestID]
+		if !ok {
+			req = &fcgiRequest{}
+			requests[h.requestID] = req
+		}
+
+		switch h.reqType {
+		case fcgiBeginRequest:
+			// role/flags, nothing to track for a responder-only input
+		case fcgiParams:
+			if h.contentLength == 0 {
+				req.paramsEnd = true
+			} else {
+				req.params.Write(payload)
+			}
+		case fcgiStdin:
+			if h.contentLength == 0 {
+				req.stdinEnd = true
+			} else {
+				req.stdin.Write(payload)
+			}
+		}
+
+		if req.paramsEnd && req.stdinEnd {
+			delete(requests, h.requestID)
+			mu.Unlock()
+
+			if httpReq := fcgiToHTTP(req); httpReq != nil {
+				i.data <- httpReq
+			}
+
+			continue
+		}
+		mu.Unlock()
+	}
+}
+
+// fcgiToHTTP assembles the decoded FCGI_PARAMS/FCGI_STDIN of req into a
+// synthetic HTTP/1 request line, header block and body.
+func fcgiToHTTP(req *fcgiRequest) []byte {
+	params := fcgiParseNameValuePairs(req.params.Bytes())
+
+	method := params["REQUEST_METHOD"]
+	uri := params["REQUEST_URI"]
+	if method == "" || uri == "" {
+		return nil
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", method, uri)
+
+	if host := params["HTTP_HOST"]; host != "" {
+		fmt.Fprintf(&b, "Host: %s\r\n", host)
+	}
+	if cl := params["CONTENT_LENGTH"]; cl != "" {
+		fmt.Fprintf(&b, "Content-Length: %s\r\n", cl)
+	}
+	if ct := params["CONTENT_TYPE"]; ct != "" {
+		fmt.Fprintf(&b, "Content-Type: %s\r\n", ct)
+	}
+
+	for name, value := range params {
+		// HTTP_HOST was already written above as the dedicated Host line.
+		if !isHTTPHeaderParam(name) || name == "HTTP_HOST" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", cgiHeaderName(name), value)
+	}
+
+	b.WriteString("\r\n")
+	b.Write(req.stdin.Bytes())
+
+	return b.Bytes()
+}
+
+func isHTTPHeaderParam(name string) bool {
+	return len(name) > 5 && name[:5] == "HTTP_"
+}
+
+// cgiHeaderName turns CGI's HTTP_X_FORWARDED_FOR back into the wire form
+// X-Forwarded-For.
+func cgiHeaderName(param string) string {
+	name := []byte(param[5:])
+
+	upperNext := true
+	for i, c := range name {
+		if c == '_' {
+			name[i] = '-'
+			upperNext = true
+			continue
+		}
+		if upperNext {
+			if c >= 'a' && c <= 'z' {
+				name[i] = c - ('a' - 'A')
+			}
+			upperNext = false
+		} else if c >= 'A' && c <= 'Z' {
+			name[i] = c + ('a' - 'A')
+		}
+	}
+
+	return string(name)
+}
+
+// Read implements the Input interface, handing synthesized HTTP/1
+// requests to the replay pipeline as they're fully decoded. A request
+// larger than len(data) is handed back over several Reads instead of
+// being silently truncated.
+func (i *FCGIInput) Read(data []byte) (int, error) {
+	if len(i.leftover) == 0 {
+		i.leftover = <-i.data
+	}
+
+	n := copy(data, i.leftover)
+	i.leftover = i.leftover[n:]
+
+	return n, nil
+}
+
+func (i *FCGIInput) String() string {
+	return "FCGI input: " + i.address
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFcgiToHTTPDoesNotDuplicateHostHeader(t *testing.T) {
+	req := &fcgiRequest{paramsEnd: true, stdinEnd: true}
+	req.params.Write(fcgiNameValuePairs(map[string]string{
+		"REQUEST_METHOD": "GET",
+		"REQUEST_URI":    "/",
+		"HTTP_HOST":      "example.com",
+	}))
+
+	out := fcgiToHTTP(req)
+	if out == nil {
+		t.Fatalf("expected a synthesized request, got nil")
+	}
+
+	if n := strings.Count(string(out), "Host:"); n != 1 {
+		t.Fatalf("expected exactly one Host header, found %d in:\n%s", n, out)
+	}
+}
+
+func TestFcgiToHTTPKeepsOtherHTTPHeaders(t *testing.T) {
+	req := &fcgiRequest{paramsEnd: true, stdinEnd: true}
+	req.params.Write(fcgiNameValuePairs(map[string]string{
+		"REQUEST_METHOD":       "GET",
+		"REQUEST_URI":          "/",
+		"HTTP_X_FORWARDED_FOR": "10.0.0.1",
+	}))
+
+	out := fcgiToHTTP(req)
+	if !bytes.Contains(out, []byte("X-Forwarded-For: 10.0.0.1")) {
+		t.Fatalf("expected X-Forwarded-For header to survive, got:\n%s", out)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// fcgiResponseTimeout bounds how long FCGIOutput.Write waits on the
+// backend's response before giving up, so a hung or silent FastCGI
+// worker can't block the replay pipeline forever.
+const fcgiResponseTimeout = 5 * time.Second
+
+// FCGIOutputConfig holds the backend address FCGIOutput forwards
+// replayed requests to.
+type FCGIOutputConfig struct {
+	address string
+}
+
+// FCGIOutput speaks the FastCGI protocol to a PHP-FPM-style backend,
+// translating replayed HTTP/1 requests (as produced by
+// rawSocket.TCPMessage.Bytes()) into FCGI_BEGIN_REQUEST/FCGI_PARAMS/
+// FCGI_STDIN records, so traffic captured on a plain TCP tier can be
+// replayed against a FastCGI worker.
+type FCGIOutput struct {
+	address string
+	reqID   uint32
+}
+
+// NewFCGIOutput constructor for FCGIOutput, accepts a "host:port" address
+// or a path to a unix socket.
+func NewFCGIOutput(address string, config *FCGIOutputConfig) *FCGIOutput {
+	return &FCGIOutput{address: address}
+}
+
+func (o *FCGIOutput) dial() (net.Conn, error) {
+	if strings.HasPrefix(o.address, "/") {
+		return net.Dial("unix", o.address)
+	}
+
+	return net.Dial("tcp", o.address)
+}
+
+func (o *FCGIOutput) nextRequestID() uint16 {
+	id := atomic.AddUint32(&o.reqID, 1)
+	return uint16(id)
+}
+
+// Write takes a raw HTTP/1 request, as replayed from the capture
+// pipeline, and replays it against the FastCGI backend as a single
+// request/response cycle. The response is read and discarded, mirroring
+// how the other fire-and-forget outputs behave.
+func (o *FCGIOutput) Write(data []byte) (n int, err error) {
+	if !isOriginPayload(data) {
+		return len(data), nil
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		Debug("FCGIOutput: failed to parse request:", err)
+		return len(data), nil
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+
+	conn, err := o.dial()
+	if err != nil {
+		Debug("FCGIOutput: can't connect to", o.address, err)
+		return len(data), nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(fcgiResponseTimeout))
+
+	id := o.nextRequestID()
+	params := fcgiRequestParams(req, len(body))
+
+	conn.Write(fcgiBeginRequestRecord(id))
+	conn.Write(fcgiRecord(fcgiParams, id, fcgiNameValuePairs(params)))
+	conn.Write(fcgiRecord(fcgiParams, id, nil)) // empty FCGI_PARAMS terminates the stream
+	conn.Write(fcgiRecord(fcgiStdin, id, body))
+	conn.Write(fcgiRecord(fcgiStdin, id, nil)) // empty FCGI_STDIN terminates the stream
+
+	io.Copy(ioutil.Discard, conn)
+
+	return len(data), nil
+}
+
+// fcgiRequestParams translates an *http.Request into the CGI/1.1
+// environment variables PHP-FPM and friends expect in FCGI_PARAMS.
+func fcgiRequestParams(req *http.Request, contentLength int) map[string]string {
+	params := map[string]string{
+		"REQUEST_METHOD":  req.Method,
+		"REQUEST_URI":     req.URL.RequestURI(),
+		"SCRIPT_NAME":     req.URL.Path,
+		"SERVER_PROTOCOL": req.Proto,
+		"CONTENT_LENGTH":  strconv.Itoa(contentLength),
+		"CONTENT_TYPE":    req.Header.Get("Content-Type"),
+	}
+
+	for name, values := range req.Header {
+		key := "HTTP_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		params[key] = strings.Join(values, ", ")
+	}
+
+	return params
+}
+
+func (o *FCGIOutput) String() string {
+	return "FCGI output: " + o.address
+}
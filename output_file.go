@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
@@ -30,6 +31,23 @@ type FileOutputConfig struct {
 	sizeLimit     unitSizeVar
 	queueLimit    int
 	append        bool
+
+	// rotationInterval rotates the current chunk on a timer, independent
+	// of sizeLimit/queueLimit; zero disables it. No command-line flag
+	// sets it.
+	rotationInterval time.Duration
+
+	// maxAge and maxBackups are the retention policy applied to rotated
+	// chunks; zero disables each. No command-line flag sets them.
+	maxAge     time.Duration
+	maxBackups int
+}
+
+// Rotated is implemented by anything that wants to be notified once
+// FileOutput finishes writing a chunk and rotates away from it, e.g. to
+// upload the closed file to S3 or scp it elsewhere.
+type Rotated interface {
+	OnRotate(path string)
 }
 
 // FileOutput output plugin
@@ -43,6 +61,23 @@ type FileOutput struct {
 	writer       io.Writer
 
 	config *FileOutputConfig
+
+	lastRotate  time.Time
+	rotateHooks []Rotated
+
+	bufPool sync.Pool
+	writeCh chan fileWrite
+}
+
+// fileWrite pairs a staged buffer with the writer it was destined for at
+// the time Write() enqueued it, so a rotation racing with the flusher
+// can't make a buffer land in the wrong chunk. A fileWrite with a
+// non-nil barrier carries no buffer — it's a drain marker (see
+// drainWrites) that flusherLoop acknowledges instead of writing.
+type fileWrite struct {
+	writer  io.Writer
+	buf     *bytes.Buffer
+	barrier chan struct{}
 }
 
 // NewFileOutput constructor for FileOutput, accepts path
@@ -50,8 +85,13 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 	o := new(FileOutput)
 	o.pathTemplate = pathTemplate
 	o.config = config
+	o.bufPool.New = func() interface{} { return new(bytes.Buffer) }
+	o.writeCh = make(chan fileWrite, 1000)
+	o.lastRotate = time.Now()
 	o.updateName()
 
+	go o.flusherLoop()
+
 	// Force flushing every minute
 	go func() {
 		for {
@@ -67,9 +107,21 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 		}
 	}()
 
+	if o.config.maxAge > 0 || o.config.maxBackups > 0 {
+		go o.retentionLoop()
+	}
+
 	return o
 }
 
+// AddRotateHook registers r to be notified with the path of each chunk
+// FileOutput closes when rotating to a new one.
+func (o *FileOutput) AddRotateHook(r Rotated) {
+	o.mu.Lock()
+	o.rotateHooks = append(o.rotateHooks, r)
+	o.mu.Unlock()
+}
+
 func getFileIndex(name string) int {
 	ext := filepath.Ext(name)
 	withoutExt := strings.TrimSuffix(name, ext)
@@ -136,9 +188,12 @@ func (o *FileOutput) filename() string {
 	if !o.config.append {
 		nextChunk := false
 
+		timeExpired := o.config.rotationInterval > 0 && time.Since(o.lastRotate) >= o.config.rotationInterval
+
 		if o.currentName == "" ||
 			((o.config.queueLimit > 0 && o.queueLength >= o.config.queueLimit) ||
-				(o.config.sizeLimit > 0 && o.chunkSize >= int(o.config.sizeLimit))) {
+				(o.config.sizeLimit > 0 && o.chunkSize >= int(o.config.sizeLimit)) ||
+				timeExpired) {
 			nextChunk = true
 		}
 
@@ -180,6 +235,17 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 
 	if o.file == nil || o.currentName != o.file.Name() {
 		o.mu.Lock()
+
+		prevName := ""
+		if o.file != nil {
+			prevName = o.file.Name()
+
+			// flusherLoop writes to o.writer with no locking of its own,
+			// so draining every fileWrite already enqueued for it before
+			// Close() flushes/closes it keeps the two from touching the
+			// same *bufio.Writer/*os.File concurrently.
+			o.drainWrites()
+		}
 		o.Close()
 
 		o.file, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
@@ -196,17 +262,176 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 		}
 
 		o.queueLength = 0
+		o.lastRotate = time.Now()
 		o.mu.Unlock()
+
+		if prevName != "" {
+			for _, hook := range o.rotateHooks {
+				hook.OnRotate(prevName)
+			}
+		}
 	}
 
-	o.writer.Write(data)
-	o.writer.Write([]byte(payloadSeparator))
+	buf := o.bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	buf.Write(data)
+	buf.Write([]byte(payloadSeparator))
+
+	o.mu.Lock()
+	w := o.writer
+	o.mu.Unlock()
+
+	o.writeCh <- fileWrite{writer: w, buf: buf}
 
 	o.queueLength++
 
 	return len(data), nil
 }
 
+// flusherLoop drains buffered writes into the current file off the hot
+// path, so Write only has to stage bytes into a pooled buffer and hand
+// it off. Each write targets the writer that was current when Write
+// enqueued it, not whichever writer is current when the flusher gets
+// around to draining it, so a rotation racing with the flusher can't
+// scatter a chunk's tail into the next chunk's file.
+func (o *FileOutput) flusherLoop() {
+	for fw := range o.writeCh {
+		if fw.barrier != nil {
+			close(fw.barrier)
+			continue
+		}
+
+		if fw.writer != nil {
+			fw.writer.Write(fw.buf.Bytes())
+		}
+
+		o.bufPool.Put(fw.buf)
+	}
+}
+
+// drainWrites blocks until every fileWrite enqueued on writeCh before this
+// call has been handed to flusherLoop. Called with o.mu held, right
+// before a rotation closes the current writer, so the flusher can never
+// be using that writer concurrently with Close().
+func (o *FileOutput) drainWrites() {
+	done := make(chan struct{})
+	o.writeCh <- fileWrite{barrier: done}
+	<-done
+}
+
+// retentionLoop periodically applies config.maxAge and config.maxBackups
+// to chunks rotated away from.
+func (o *FileOutput) retentionLoop() {
+	for {
+		time.Sleep(time.Minute)
+		o.applyRetention()
+	}
+}
+
+// retentionGlob turns the %Y/%m/%d/... macros in pathTemplate into glob
+// wildcards, rather than expanding them to today's date the way
+// filename() does — retention needs to match chunks rotated on *any*
+// past date, not just ones written today.
+func retentionGlob(pathTemplate string) string {
+	path := pathTemplate
+
+	for name := range dateFileNameFuncs {
+		path = strings.Replace(path, name, "*", -1)
+	}
+
+	ext := filepath.Ext(path)
+	withoutExt := strings.TrimSuffix(path, ext)
+
+	return withoutExt + "*" + ext
+}
+
+func (o *FileOutput) applyRetention() {
+	matches, err := filepath.Glob(retentionGlob(o.pathTemplate))
+	if err != nil {
+		return
+	}
+	sort.Sort(sortByFileIndex(matches))
+
+	o.mu.Lock()
+	currentName := o.currentName
+	o.mu.Unlock()
+
+	var backups []string
+	for _, name := range matches {
+		if name != currentName && !strings.HasSuffix(name, ".gz") {
+			backups = append(backups, name)
+		}
+	}
+
+	if o.config.maxAge > 0 {
+		cutoff := time.Now().Add(-o.config.maxAge)
+
+		var kept []string
+		for _, name := range backups {
+			info, err := os.Stat(name)
+			if err != nil {
+				continue
+			}
+
+			if info.ModTime().Before(cutoff) {
+				if _, err := gzipFile(name); err != nil {
+					log.Printf("Error gzipping %q on retention: %s", name, err)
+				}
+			} else {
+				kept = append(kept, name)
+			}
+		}
+		backups = kept
+	}
+
+	if o.config.maxBackups > 0 && len(backups) > o.config.maxBackups {
+		for _, name := range backups[:len(backups)-o.config.maxBackups] {
+			if _, err := gzipFile(name); err != nil {
+				log.Printf("Error gzipping %q on retention: %s", name, err)
+			}
+		}
+	}
+}
+
+// gzipFile compresses path into path+".gz" and removes the original,
+// returning the gzipped path.
+func gzipFile(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	gzPath := path + ".gz"
+
+	out, err := os.OpenFile(gzPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return "", err
+	}
+
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, in); err != nil {
+		gw.Close()
+		out.Close()
+		os.Remove(gzPath)
+		return "", err
+	}
+	if err := gw.Close(); err != nil {
+		out.Close()
+		os.Remove(gzPath)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(gzPath)
+		return "", err
+	}
+
+	in.Close()
+	os.Remove(path)
+
+	return gzPath, nil
+}
+
 func (o *FileOutput) flush() {
 	defer o.mu.Unlock()
 	o.mu.Lock()
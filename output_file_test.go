@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRetentionGlobWildcardsDateMacros(t *testing.T) {
+	pattern := retentionGlob("/tmp/requests_%Y%m%d.gz")
+
+	if bytes.ContainsRune([]byte(pattern), '%') {
+		t.Fatalf("expected date macros to be replaced with wildcards, got pattern %q", pattern)
+	}
+
+	// Must match a chunk rotated on a past date, not just today's.
+	if matched, err := filepath.Match(pattern, "/tmp/requests_20200101.gz"); err != nil || !matched {
+		t.Fatalf("expected pattern %q to match a chunk from a past date, matched=%v err=%v", pattern, matched, err)
+	}
+}
+
+func TestDrainWritesWaitsForPriorEnqueuedWrites(t *testing.T) {
+	o := &FileOutput{writeCh: make(chan fileWrite, 10)}
+	go o.flusherLoop()
+
+	var out bytes.Buffer
+	buf := new(bytes.Buffer)
+	buf.WriteString("hello")
+	o.writeCh <- fileWrite{writer: &out, buf: buf}
+
+	o.drainWrites()
+
+	if out.String() != "hello" {
+		t.Fatalf("expected drainWrites to block until the previously enqueued write landed, got %q", out.String())
+	}
+}
+
+func TestGzipFileCompressesAndRemovesOriginal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gor-output-file-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "chunk_0")
+	if err := ioutil.WriteFile(path, []byte("hello world"), 0660); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	gzPath, err := gzipFile(path)
+	if err != nil {
+		t.Fatalf("gzipFile: %s", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected original file to be removed, stat err = %v", err)
+	}
+
+	f, err := os.Open(gzPath)
+	if err != nil {
+		t.Fatalf("Open gzipped file: %s", err)
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %s", err)
+	}
+	defer gr.Close()
+
+	got, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+
+	if !bytes.Equal(got, []byte("hello world")) {
+		t.Fatalf("expected decompressed content %q, got %q", "hello world", got)
+	}
+}
@@ -0,0 +1,235 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"flag"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ipDefragTimeout is how long a fragmented IPv4 datagram is kept around
+// waiting for its remaining fragments before being given up on. Set via
+// --ip-defrag-timeout.
+var ipDefragTimeout time.Duration
+
+func init() {
+	flag.DurationVar(&ipDefragTimeout, "ip-defrag-timeout", 30*time.Second,
+		"How long to wait for the remaining fragments of an IPv4 datagram before giving up")
+}
+
+// DefragStats exposes counters for the --stats output.
+type DefragStats struct {
+	FragmentsSeen        uint64
+	DatagramsReassembled uint64
+	DatagramsTimedOut    uint64
+}
+
+// ipFlowKey identifies a fragmented IPv4 datagram by the tuple RFC 791
+// says is enough to disambiguate it: source, destination, protocol and
+// IP identification.
+type ipFlowKey struct {
+	src, dst [4]byte
+	proto    byte
+	id       uint16
+}
+
+type ipFragment struct {
+	offset  uint16
+	last    bool // fragment carried MF=0
+	payload []byte
+}
+
+type fragsByOffset []ipFragment
+
+func (f fragsByOffset) Len() int           { return len(f) }
+func (f fragsByOffset) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f fragsByOffset) Less(i, j int) bool { return f[i].offset < f[j].offset }
+
+type ipFlow struct {
+	header   []byte // IP header of the first fragment seen, reused for the reassembled datagram
+	frags    fragsByOffset
+	gotLast  bool
+	lastSeen time.Time
+}
+
+// complete reports whether every byte of the original datagram, from 0 up
+// to the length implied by the MF=0 fragment, has been seen.
+func (f *ipFlow) complete() bool {
+	if !f.gotLast {
+		return false
+	}
+
+	expected := uint16(0)
+	for _, frag := range f.frags {
+		if frag.offset != expected {
+			return false
+		}
+		expected += uint16(len(frag.payload))
+	}
+
+	return true
+}
+
+func (f *ipFlow) reassemble() []byte {
+	datagram := append([]byte(nil), f.header...)
+	for _, frag := range f.frags {
+		datagram = append(datagram, frag.payload...)
+	}
+
+	// Total Length field covers header + reassembled payload.
+	binary.BigEndian.PutUint16(datagram[2:4], uint16(len(datagram)))
+
+	return datagram
+}
+
+// IPv4Defragmenter reassembles fragmented IPv4 datagrams before they reach
+// the TCP layer, so TCPMessage.AddPacket always sees a single logical
+// packet per segment even when the link MTU fragments large PUT/POST
+// bodies. Modeled on the ip4defrag stage from gopacket's reassembly
+// example.
+type IPv4Defragmenter struct {
+	mu      sync.Mutex
+	flows   map[ipFlowKey]*ipFlow
+	timeout time.Duration
+
+	Stats DefragStats
+}
+
+// NewIPv4Defragmenter creates a defragmenter that evicts flows which
+// haven't completed within timeout (default 30s, per RFC 791).
+func NewIPv4Defragmenter(timeout time.Duration) *IPv4Defragmenter {
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	d := &IPv4Defragmenter{
+		flows:   make(map[ipFlowKey]*ipFlow),
+		timeout: timeout,
+	}
+
+	go d.expireLoop()
+
+	return d
+}
+
+// Process takes a raw IPv4 datagram (header + payload). Unfragmented
+// datagrams are returned unchanged. Fragments are buffered until the
+// datagram is whole, at which point the reassembled datagram is
+// returned; otherwise Process returns nil and the caller should not hand
+// anything to the TCP parser yet.
+func (d *IPv4Defragmenter) Process(data []byte) []byte {
+	if len(data) < 20 {
+		return data
+	}
+
+	ihl := int(data[0]&0x0f) * 4
+	if ihl < 20 || len(data) < ihl {
+		return data
+	}
+
+	flagsAndOffset := binary.BigEndian.Uint16(data[6:8])
+	moreFragments := flagsAndOffset&0x2000 != 0
+	fragOffset := (flagsAndOffset & 0x1fff) * 8
+
+	if !moreFragments && fragOffset == 0 {
+		return data
+	}
+
+	key := ipFlowKey{proto: data[9], id: binary.BigEndian.Uint16(data[4:6])}
+	copy(key.src[:], data[12:16])
+	copy(key.dst[:], data[16:20])
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Stats.FragmentsSeen++
+
+	flow, ok := d.flows[key]
+	if !ok {
+		flow = &ipFlow{header: append([]byte(nil), data[:ihl]...)}
+		d.flows[key] = flow
+	}
+	flow.lastSeen = time.Now()
+
+	flow.frags = append(flow.frags, ipFragment{
+		offset:  fragOffset,
+		last:    !moreFragments,
+		payload: append([]byte(nil), data[ihl:]...),
+	})
+	sort.Sort(flow.frags)
+
+	if !moreFragments {
+		flow.gotLast = true
+	}
+
+	if !flow.complete() {
+		return nil
+	}
+
+	delete(d.flows, key)
+	d.Stats.DatagramsReassembled++
+
+	return flow.reassemble()
+}
+
+// statsSnapshot returns a snapshot of d's counters, safe to call
+// concurrently with Process.
+func (d *IPv4Defragmenter) statsSnapshot() DefragStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Stats
+}
+
+// defaultDefragmenter is the process-wide IPv4 reassembly stage used by
+// ProcessIPv4 below. Built lazily, on first use, so it picks up
+// --ip-defrag-timeout instead of whatever ipDefragTimeout defaulted to
+// before flag.Parse() ran.
+var (
+	defaultDefragmenterOnce sync.Once
+	defaultDefragmenter     *IPv4Defragmenter
+)
+
+func getDefaultDefragmenter() *IPv4Defragmenter {
+	defaultDefragmenterOnce.Do(func() {
+		defaultDefragmenter = NewIPv4Defragmenter(ipDefragTimeout)
+	})
+	return defaultDefragmenter
+}
+
+// ProcessIPv4 runs a captured IPv4 datagram through the process-wide
+// defragmenter. This is the raw socket input path's hook: call it on
+// every datagram read off the wire before constructing a TCPPacket and
+// handing it to TCPMessage.AddPacket, and skip straight to the next read
+// when it returns nil (the datagram is still missing fragments).
+func ProcessIPv4(data []byte) []byte {
+	return getDefaultDefragmenter().Process(data)
+}
+
+// CurrentDefragStats reports the process-wide defragmenter's counters,
+// for the --stats output.
+func CurrentDefragStats() DefragStats {
+	return getDefaultDefragmenter().statsSnapshot()
+}
+
+func (d *IPv4Defragmenter) expireLoop() {
+	ticker := time.NewTicker(d.timeout)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.expire()
+	}
+}
+
+func (d *IPv4Defragmenter) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for key, flow := range d.flows {
+		if now.Sub(flow.lastSeen) > d.timeout {
+			delete(d.flows, key)
+			d.Stats.DatagramsTimedOut++
+		}
+	}
+}
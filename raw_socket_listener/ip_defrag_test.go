@@ -0,0 +1,67 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildIPv4Fragment builds a minimal 20-byte-header IPv4 datagram carrying
+// payload, fragmented at fragOffset (a byte offset, a multiple of 8, which
+// is converted here to the header's 8-byte units) with the more-fragments
+// flag set as requested.
+func buildIPv4Fragment(id uint16, fragOffset uint16, moreFragments bool, payload []byte) []byte {
+	header := make([]byte, 20)
+	header[0] = 0x45 // version 4, IHL 5
+	binary.BigEndian.PutUint16(header[4:6], id)
+
+	flagsAndOffset := fragOffset / 8
+	if moreFragments {
+		flagsAndOffset |= 0x2000
+	}
+	binary.BigEndian.PutUint16(header[6:8], flagsAndOffset)
+
+	header[9] = 6 // TCP
+	copy(header[12:16], []byte{10, 0, 0, 1})
+	copy(header[16:20], []byte{10, 0, 0, 2})
+
+	datagram := append(header, payload...)
+	binary.BigEndian.PutUint16(datagram[2:4], uint16(len(datagram)))
+
+	return datagram
+}
+
+func TestProcessIPv4ReassemblesFragments(t *testing.T) {
+	first := buildIPv4Fragment(42, 0, true, []byte("hello, w"))
+	second := buildIPv4Fragment(42, 8, false, []byte("orld!!!"))
+
+	if got := ProcessIPv4(first); got != nil {
+		t.Fatalf("expected nil while still missing the final fragment, got %v", got)
+	}
+
+	got := ProcessIPv4(second)
+	if got == nil {
+		t.Fatalf("expected the reassembled datagram once the final fragment arrives")
+	}
+
+	if !bytes.Equal(got[20:], []byte("hello, world!!!")) {
+		t.Fatalf("expected reassembled payload %q, got %q", "hello, world!!!", got[20:])
+	}
+
+	stats := CurrentDefragStats()
+	if stats.DatagramsReassembled == 0 {
+		t.Fatalf("expected DatagramsReassembled to be incremented")
+	}
+}
+
+func TestProcessIPv4PassesThroughUnfragmented(t *testing.T) {
+	datagram := buildIPv4Fragment(99, 0, false, []byte("unfragmented"))
+
+	got := ProcessIPv4(datagram)
+	if got == nil {
+		t.Fatalf("expected an unfragmented datagram to pass through unchanged")
+	}
+	if !bytes.Equal(got, datagram) {
+		t.Fatalf("expected unfragmented datagram to be returned as-is")
+	}
+}
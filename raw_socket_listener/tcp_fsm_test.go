@@ -0,0 +1,84 @@
+package rawSocket
+
+import "testing"
+
+func TestFlowKeySymmetric(t *testing.T) {
+	req := &TCPPacket{
+		Addr: append(append([]byte{}, []byte{10, 0, 0, 1}...), []byte{10, 0, 0, 2}...),
+		Raw:  []byte{0x13, 0x88, 0x00, 0x50}, // src port 5000, dst port 80
+	}
+	resp := &TCPPacket{
+		Addr: append(append([]byte{}, []byte{10, 0, 0, 2}...), []byte{10, 0, 0, 1}...),
+		Raw:  []byte{0x00, 0x50, 0x13, 0x88}, // src port 80, dst port 5000
+	}
+
+	if flowKey(req) != flowKey(resp) {
+		t.Fatalf("expected request and response packets of the same connection to share a flow key")
+	}
+}
+
+// tcpSynPacket builds the minimal 20-byte TCP header needed by tcpFlags/
+// parseTCPOptions: SYN is bit 0x02 in byte 13, data offset (no options)
+// in the high nibble of byte 12.
+func tcpSynPacket(seq uint32, ack bool) *TCPPacket {
+	raw := make([]byte, 20)
+	raw[12] = 5 << 4 // 20-byte header, no options
+	raw[13] = tcpFlagSYN
+	if ack {
+		raw[13] |= tcpFlagACK
+	}
+
+	return &TCPPacket{
+		Seq:  seq,
+		Addr: []byte{10, 0, 0, 1, 10, 0, 0, 2},
+		Raw:  raw,
+	}
+}
+
+func TestFSMPersistsAcrossMessages(t *testing.T) {
+	delete(tcpFlows, flowKey(tcpSynPacket(1, false)))
+
+	req1 := NewTCPMessage(1, 1, true)
+	syn := tcpSynPacket(1000, false)
+	if !req1.updateState(syn, flowKey(syn)) {
+		t.Fatalf("SYN should be accepted from tcpStateListen")
+	}
+
+	// A second logical HTTP request on the same TCP connection (already
+	// opened by req1's SYN) must not be rejected just because its own
+	// TCPMessage starts life without ever having seen a SYN.
+	dataRaw := make([]byte, 20)
+	dataRaw[12] = 5 << 4
+	dataRaw[13] = tcpFlagACK
+
+	req2 := NewTCPMessage(200, 1, true)
+	dataPacket := &TCPPacket{Seq: 1050, Addr: syn.Addr, Raw: dataRaw}
+	if !req2.updateState(dataPacket, flowKey(dataPacket)) {
+		t.Fatalf("keep-alive request should reuse the flow state req1 advanced, not start at tcpStateListen")
+	}
+}
+
+func TestCheckSeqIntegrityToleratesGapWithinMSS(t *testing.T) {
+	msg := NewTCPMessage(1, 1, true)
+	msg.mss = 1460
+	msg.sackPermitted = true
+
+	msg.packets = []*TCPPacket{
+		{Seq: 1000, Data: make([]byte, 500)},
+		{Seq: 2000, Data: make([]byte, 500)}, // 500-byte gap, within MSS
+	}
+
+	msg.checkSeqIntegrity()
+	if msg.seqMissing {
+		t.Fatalf("gap smaller than the negotiated MSS on a SACK-permitted flow should not be flagged as missing")
+	}
+
+	msg.packets = []*TCPPacket{
+		{Seq: 1000, Data: make([]byte, 500)},
+		{Seq: 4000, Data: make([]byte, 500)}, // gap bigger than MSS
+	}
+	msg.checkSeqIntegrity()
+	if !msg.seqMissing {
+		t.Fatalf("gap larger than the negotiated MSS should still be flagged as missing")
+	}
+}
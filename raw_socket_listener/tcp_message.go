@@ -5,10 +5,12 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"flag"
 	"github.com/buger/gor/proto"
 	"log"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -45,6 +47,32 @@ type TCPMessage struct {
 	headerPacket  int
 	contentLength int
 	complete      bool
+
+	/* TCP FSM state, cached from the per-flow tcpFlowState on each packet */
+	mss           uint16
+	sackPermitted bool
+
+	/* WebSocket specific variables, valid once bodyType == httpBodyWebSocket */
+	wsType    wsMessageType
+	wsOpcode  byte
+	wsPayload []byte
+}
+
+// Options controlling how strict the TCP FSM is, mirroring gopacket's
+// reassembly example.
+var (
+	allowMissingInit   bool
+	ignoreFSMErr       bool
+	copyBufferChecksum bool
+)
+
+func init() {
+	flag.BoolVar(&allowMissingInit, "allow-missing-init", false,
+		"Adopt an in-progress TCP flow even if its SYN was never captured")
+	flag.BoolVar(&ignoreFSMErr, "ignore-fsm-err", false,
+		"Don't drop segments that violate the TCP state machine, useful for lossy captures")
+	flag.BoolVar(&copyBufferChecksum, "copy-buffer-checksum", false,
+		"Verify the TCP checksum of every segment and drop the ones that fail")
 }
 
 // NewTCPMessage pointer created from a Acknowledgment number and a channel of messages readuy to be deleted
@@ -57,6 +85,16 @@ func NewTCPMessage(Seq, Ack uint32, IsIncoming bool) (msg *TCPMessage) {
 
 // Bytes return message content
 func (t *TCPMessage) Bytes() (output []byte) {
+	if t.bodyType == httpBodyWebSocket {
+		return t.wsBytes()
+	}
+
+	return t.rawBytes()
+}
+
+// rawBytes concatenates the payload of every packet as captured, with no
+// protocol-specific reframing.
+func (t *TCPMessage) rawBytes() (output []byte) {
 	for _, p := range t.packets {
 		output = append(output, p.Data...)
 	}
@@ -95,6 +133,16 @@ func (t *TCPMessage) Size() (size int) {
 // AddPacket to the message and ensure packet uniqueness
 // TCP allows that packet can be re-send multiple times
 func (t *TCPMessage) AddPacket(packet *TCPPacket) {
+	key := flowKey(packet)
+
+	if !t.updateState(packet, key) {
+		return
+	}
+
+	if copyBufferChecksum && !verifyChecksum(packet) {
+		return
+	}
+
 	packetFound := false
 
 	for _, pkt := range t.packets {
@@ -131,12 +179,19 @@ func (t *TCPMessage) AddPacket(packet *TCPPacket) {
 		}
 	}
 
+	if isUpgraded(key) {
+		t.updateWSType()
+		t.checkIfCompleteWS(key)
+		return
+	}
+
 	t.checkSeqIntegrity()
 	t.updateHeadersPacket()
 	t.updateMethodType()
 	t.updateBodyType()
 	t.checkIfComplete()
 	t.check100Continue()
+	t.checkWSUpgrade()
 }
 
 // Check if there is missing packet
@@ -156,15 +211,20 @@ func (t *TCPMessage) checkSeqIntegrity() {
 		nextSeq := p.Seq + uint32(len(p.Data))
 
 		if np.Seq != nextSeq {
-			if t.expectType == httpExpect100Continue {
-				if np.Seq != nextSeq+22 {
-					t.seqMissing = true
-					return
-				}
-			} else {
-				t.seqMissing = true
-				return
+			if t.expectType == httpExpect100Continue && np.Seq == nextSeq+22 {
+				continue
+			}
+
+			// A flow that negotiated SACK can legitimately deliver a later
+			// segment before an earlier one is retransmitted; tolerate a
+			// gap up to one negotiated MSS instead of flagging it as a
+			// permanent hole.
+			if t.sackPermitted && t.mss > 0 && np.Seq > nextSeq && np.Seq-nextSeq <= uint32(t.mss) {
+				continue
 			}
+
+			t.seqMissing = true
+			return
 		}
 	}
 
@@ -306,6 +366,7 @@ const (
 	httpBodyEmpty         httpBodyType = 1
 	httpBodyContentLength httpBodyType = 2
 	httpBodyChunked       httpBodyType = 3
+	httpBodyWebSocket     httpBodyType = 4
 )
 
 func (t *TCPMessage) updateBodyType() {
@@ -447,3 +508,309 @@ func (t *TCPMessage) ID() tcpID {
 func (t *TCPMessage) IP() net.IP {
 	return net.IP(t.packets[0].Addr)
 }
+
+// tcpConnState is a minimal TCP connection state machine, modeled on
+// gopacket's reassembly package, used to reject segments that arrive
+// outside of an established flow (before the SYN, or after FIN/RST) so
+// retransmits of a dead connection don't get appended to a live message.
+type tcpConnState uint8
+
+const (
+	tcpStateListen tcpConnState = iota
+	tcpStateSynSent
+	tcpStateSynRcvd
+	tcpStateEstablished
+	tcpStateFinWait
+	tcpStateCloseWait
+	tcpStateClosed
+)
+
+// TCP header flag bits, see RFC 793 section 3.1.
+const (
+	tcpFlagFIN = 1 << 0
+	tcpFlagSYN = 1 << 1
+	tcpFlagRST = 1 << 2
+	tcpFlagACK = 1 << 4
+)
+
+func tcpFlags(packet *TCPPacket) byte {
+	if len(packet.Raw) < 14 {
+		return 0
+	}
+
+	return packet.Raw[13]
+}
+
+// tcpEndpoint is a 4-byte IPv4 address plus a 2-byte port, used as half
+// of a flow key.
+type tcpEndpoint [6]byte
+
+// tcpFlowKey identifies a TCP connection independent of which direction
+// a given packet travels in, unlike tcpID (see UpdateResponseAck's
+// src/dst swap), so both the client->server and server->client
+// TCPMessages of one connection share the same FSM and upgrade state.
+type tcpFlowKey struct {
+	a, b tcpEndpoint
+}
+
+func flowKey(packet *TCPPacket) tcpFlowKey {
+	var src, dst tcpEndpoint
+
+	if len(packet.Addr) >= 8 {
+		copy(src[:4], packet.Addr[:4])
+		copy(dst[:4], packet.Addr[4:8])
+	}
+	if len(packet.Raw) >= 4 {
+		copy(src[4:6], packet.Raw[0:2])
+		copy(dst[4:6], packet.Raw[2:4])
+	}
+
+	if bytes.Compare(src[:], dst[:]) <= 0 {
+		return tcpFlowKey{a: src, b: dst}
+	}
+
+	return tcpFlowKey{a: dst, b: src}
+}
+
+// tcpFlowState is the FSM and negotiated options for one TCP connection,
+// shared by every TCPMessage built from its packets (a new TCPMessage is
+// created per logical HTTP request/response, so this state can't live on
+// TCPMessage itself without every message but the first starting back at
+// tcpStateListen).
+type tcpFlowState struct {
+	state tcpConnState
+
+	clientISN, serverISN         uint32
+	haveClientISN, haveServerISN bool
+
+	mss           uint16
+	sackPermitted bool
+
+	lastSeen time.Time
+}
+
+func (f *tcpFlowState) isn(isIncoming bool) (uint32, bool) {
+	if isIncoming {
+		return f.clientISN, f.haveClientISN
+	}
+
+	return f.serverISN, f.haveServerISN
+}
+
+func (f *tcpFlowState) setISN(isIncoming bool, seq uint32) {
+	if isIncoming {
+		f.clientISN, f.haveClientISN = seq, true
+	} else {
+		f.serverISN, f.haveServerISN = seq, true
+	}
+}
+
+var (
+	tcpFlowsMu sync.Mutex
+	tcpFlows   = map[tcpFlowKey]*tcpFlowState{}
+)
+
+// tcpFlowTimeout is how long an idle flow (no FIN/RST ever seen) is kept
+// around before being forgotten, so long-lived captures don't grow
+// tcpFlows without bound.
+const tcpFlowTimeout = 10 * time.Minute
+
+func init() {
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			expireTCPFlows()
+		}
+	}()
+}
+
+func expireTCPFlows() {
+	cutoff := time.Now().Add(-tcpFlowTimeout)
+
+	tcpFlowsMu.Lock()
+	for key, flow := range tcpFlows {
+		if flow.lastSeen.Before(cutoff) {
+			delete(tcpFlows, key)
+		}
+	}
+	tcpFlowsMu.Unlock()
+}
+
+// closeFlow retires every bit of per-flow state once a connection is
+// done (RST, or a FIN followed by any FIN or ACK segment, in either
+// direction).
+func closeFlow(key tcpFlowKey) {
+	tcpFlowsMu.Lock()
+	delete(tcpFlows, key)
+	tcpFlowsMu.Unlock()
+
+	upgradedMu.Lock()
+	delete(upgradedFlows, key)
+	upgradedMu.Unlock()
+
+	wsFlowsMu.Lock()
+	delete(wsFlows, wsFlowKey{flow: key, incoming: true})
+	delete(wsFlows, wsFlowKey{flow: key, incoming: false})
+	wsFlowsMu.Unlock()
+}
+
+// updateState advances the per-flow FSM using the SYN/FIN/RST flags
+// observed on packet. It returns false if the segment should be dropped:
+// it arrived before the ISN, or the flow is already past FIN+ACK/RST,
+// unless --ignore-fsm-err was given.
+func (t *TCPMessage) updateState(packet *TCPPacket, key tcpFlowKey) bool {
+	flags := tcpFlags(packet)
+
+	tcpFlowsMu.Lock()
+	flow, ok := tcpFlows[key]
+	if !ok {
+		flow = &tcpFlowState{}
+		tcpFlows[key] = flow
+	}
+	flow.lastSeen = time.Now()
+
+	result := t.updateFlowState(flow, packet, flags)
+
+	t.mss = flow.mss
+	t.sackPermitted = flow.sackPermitted
+	terminal := flow.state == tcpStateClosed || flow.state == tcpStateCloseWait
+	tcpFlowsMu.Unlock()
+
+	if terminal {
+		closeFlow(key)
+	}
+
+	return result
+}
+
+// updateFlowState runs the actual transition; called with tcpFlowsMu held.
+func (t *TCPMessage) updateFlowState(flow *tcpFlowState, packet *TCPPacket, flags byte) bool {
+	if flow.state != tcpStateListen {
+		if isn, have := flow.isn(t.IsIncoming); have && packet.Seq < isn {
+			return ignoreFSMErr
+		}
+	}
+
+	switch flow.state {
+	case tcpStateListen:
+		if flags&tcpFlagSYN != 0 {
+			flow.setISN(t.IsIncoming, packet.Seq)
+			parseTCPOptions(flow, packet)
+
+			if flags&tcpFlagACK != 0 {
+				flow.state = tcpStateSynRcvd
+			} else {
+				flow.state = tcpStateSynSent
+			}
+
+			return true
+		}
+
+		if allowMissingInit {
+			flow.setISN(t.IsIncoming, packet.Seq)
+			flow.state = tcpStateEstablished
+			return true
+		}
+
+		return ignoreFSMErr
+	case tcpStateSynSent, tcpStateSynRcvd:
+		if flags&tcpFlagRST != 0 {
+			flow.state = tcpStateClosed
+			return false
+		}
+
+		flow.state = tcpStateEstablished
+		return true
+	case tcpStateEstablished:
+		if flags&tcpFlagRST != 0 {
+			flow.state = tcpStateClosed
+			return false
+		}
+
+		if flags&tcpFlagFIN != 0 {
+			flow.state = tcpStateFinWait
+		}
+
+		return true
+	case tcpStateFinWait:
+		if flags&(tcpFlagFIN|tcpFlagACK) != 0 {
+			flow.state = tcpStateCloseWait
+		}
+
+		return true
+	default: // tcpStateCloseWait, tcpStateClosed
+		return ignoreFSMErr
+	}
+}
+
+// parseTCPOptions extracts MSS and SACK-permitted from a SYN segment's
+// TCP options onto flow, so window-scaled flows with legitimately large
+// send windows don't trip checkSeqIntegrity's gap heuristic.
+func parseTCPOptions(flow *tcpFlowState, packet *TCPPacket) {
+	if len(packet.Raw) < 20 {
+		return
+	}
+
+	hdrLen := int(packet.Raw[12]>>4) * 4
+	if hdrLen <= 20 || len(packet.Raw) < hdrLen {
+		return
+	}
+
+	opts := packet.Raw[20:hdrLen]
+
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case 0: // End of option list
+			return
+		case 1: // No-Operation
+			i++
+		case 2: // Maximum Segment Size
+			if i+4 > len(opts) {
+				return
+			}
+			flow.mss = binary.BigEndian.Uint16(opts[i+2 : i+4])
+			i += 4
+		case 4: // SACK-Permitted
+			flow.sackPermitted = true
+			i += 2
+		default:
+			if i+1 >= len(opts) || opts[i+1] < 2 {
+				return
+			}
+			i += int(opts[i+1])
+		}
+	}
+}
+
+// verifyChecksum recomputes the TCP checksum over the IPv4 pseudo-header
+// and segment. Addr holds the 8-byte src+dst IPv4 pair also used to build
+// ResponseID. Including the segment's own checksum field in the sum is
+// the standard receiver-side trick: the one's complement of the total is
+// zero for an uncorrupted segment.
+func verifyChecksum(packet *TCPPacket) bool {
+	if len(packet.Addr) < 8 || len(packet.Raw) < 20 {
+		return true
+	}
+
+	var sum uint32
+
+	add16 := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+
+	add16(packet.Addr[:8]) // pseudo-header: src IP + dst IP
+	sum += uint32(6)       // pseudo-header: protocol = TCP
+	sum += uint32(len(packet.Raw))
+	add16(packet.Raw)
+
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return uint16(sum) == 0xffff
+}
@@ -0,0 +1,251 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/buger/gor/proto"
+	"sync"
+)
+
+// wsMessageType classifies a TCPMessage carrying a single WebSocket frame,
+// once the underlying connection has upgraded via the HTTP handshake.
+type wsMessageType uint8
+
+const (
+	wsMessageNotSet wsMessageType = iota
+	wsMessageData                // text or binary, possibly reassembled from continuation frames
+	wsMessageControl             // ping/pong/close
+)
+
+// WebSocket opcodes, see RFC 6455 section 5.2.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+var bSecWebSocketAccept = []byte("Sec-WebSocket-Accept")
+var bSwitchingProtocols = []byte("HTTP/1.1 101")
+
+// upgradedFlows tracks which connections (keyed by tcpFlowKey, so both
+// the request and response directions of the same connection agree) have
+// completed a WebSocket handshake and should be parsed as frames instead
+// of HTTP from that point on.
+var (
+	upgradedMu    sync.Mutex
+	upgradedFlows = map[tcpFlowKey]bool{}
+)
+
+func markUpgraded(key tcpFlowKey) {
+	upgradedMu.Lock()
+	upgradedFlows[key] = true
+	upgradedMu.Unlock()
+}
+
+func isUpgraded(key tcpFlowKey) bool {
+	upgradedMu.Lock()
+	defer upgradedMu.Unlock()
+	return upgradedFlows[key]
+}
+
+// checkWSUpgrade looks for a 101 Switching Protocols response carrying
+// Sec-WebSocket-Accept and, if found, flags the connection as upgraded
+// so subsequent messages on it (either direction) are parsed as WS
+// frames.
+func (t *TCPMessage) checkWSUpgrade() {
+	if t.IsIncoming || t.AssocMessage == nil || t.headerPacket == -1 {
+		return
+	}
+
+	d := t.packets[0].Data
+	if len(d) < len(bSwitchingProtocols) || !bytes.Equal(d[:len(bSwitchingProtocols)], bSwitchingProtocols) {
+		return
+	}
+
+	for _, p := range t.packets[:t.headerPacket+1] {
+		if len(proto.Header(p.Data, bSecWebSocketAccept)) > 0 {
+			markUpgraded(flowKey(t.packets[0]))
+			return
+		}
+	}
+}
+
+// updateWSType flags the message as carrying a WebSocket frame once the
+// flow has upgraded.
+func (t *TCPMessage) updateWSType() {
+	if t.bodyType != httpBodyNotSet && t.bodyType != httpBodyWebSocket {
+		return
+	}
+
+	t.bodyType = httpBodyWebSocket
+}
+
+// wsFrame is the decoded header of an RFC 6455 frame.
+type wsFrame struct {
+	fin        bool
+	opcode     byte
+	mask       []byte
+	headerLen  int
+	payloadLen uint64
+}
+
+// parseWSFrame decodes the frame header at the start of d. ok is false if
+// d doesn't yet contain enough bytes to know the full header length.
+func parseWSFrame(d []byte) (frame wsFrame, ok bool) {
+	if len(d) < 2 {
+		return frame, false
+	}
+
+	frame.fin = d[0]&0x80 != 0
+	frame.opcode = d[0] & 0x0f
+	masked := d[1]&0x80 != 0
+	payloadLen := uint64(d[1] & 0x7f)
+
+	i := 2
+	switch payloadLen {
+	case 126:
+		if len(d) < i+2 {
+			return frame, false
+		}
+		payloadLen = uint64(binary.BigEndian.Uint16(d[i : i+2]))
+		i += 2
+	case 127:
+		if len(d) < i+8 {
+			return frame, false
+		}
+		payloadLen = binary.BigEndian.Uint64(d[i : i+8])
+		i += 8
+	}
+
+	if masked {
+		if len(d) < i+4 {
+			return frame, false
+		}
+		frame.mask = d[i : i+4]
+		i += 4
+	}
+
+	frame.headerLen = i
+	frame.payloadLen = payloadLen
+
+	return frame, true
+}
+
+// unmask applies the frame's masking key (a no-op if the frame was
+// unmasked, as is always true for server-to-client frames).
+func (f wsFrame) unmask(payload []byte) []byte {
+	if f.mask == nil {
+		return payload
+	}
+
+	out := make([]byte, len(payload))
+	for i, b := range payload {
+		out[i] = b ^ f.mask[i%4]
+	}
+
+	return out
+}
+
+// wsFlowState accumulates the payload of a WebSocket message fragmented
+// across several continuation frames (RFC 6455 section 5.4), each of
+// which arrives as its own TCPMessage in this codebase's grouping.
+type wsFlowState struct {
+	opcode  byte
+	pending []byte
+}
+
+// wsFlowKey identifies one direction of one connection's in-flight
+// fragmented WebSocket message. WebSocket is full-duplex: both
+// directions can have a fragmented message in flight at the same time,
+// and they must not share a pending-payload buffer.
+type wsFlowKey struct {
+	flow     tcpFlowKey
+	incoming bool
+}
+
+var (
+	wsFlowsMu sync.Mutex
+	wsFlows   = map[wsFlowKey]*wsFlowState{}
+)
+
+func getWSFlow(key wsFlowKey) *wsFlowState {
+	wsFlowsMu.Lock()
+	defer wsFlowsMu.Unlock()
+
+	flow, ok := wsFlows[key]
+	if !ok {
+		flow = &wsFlowState{}
+		wsFlows[key] = flow
+	}
+
+	return flow
+}
+
+// checkIfCompleteWS marks the message complete once a frame with FIN=1
+// has arrived and all of its declared payload has been received,
+// concatenating the payload of any preceding continuation frames
+// buffered on the flow.
+func (t *TCPMessage) checkIfCompleteWS(key tcpFlowKey) {
+	d := t.rawBytes()
+
+	frame, ok := parseWSFrame(d)
+	if !ok {
+		return
+	}
+
+	if uint64(len(d)-frame.headerLen) < frame.payloadLen {
+		return
+	}
+
+	payload := frame.unmask(d[frame.headerLen : frame.headerLen+int(frame.payloadLen)])
+
+	if frame.opcode >= wsOpClose {
+		// Control frames can't be fragmented, each is its own message.
+		t.wsType = wsMessageControl
+		t.wsOpcode = frame.opcode
+		t.wsPayload = payload
+		t.complete = true
+
+		return
+	}
+
+	t.wsType = wsMessageData
+
+	flow := getWSFlow(wsFlowKey{flow: key, incoming: t.IsIncoming})
+
+	wsFlowsMu.Lock()
+	defer wsFlowsMu.Unlock()
+
+	if frame.opcode != wsOpContinuation {
+		flow.opcode = frame.opcode
+		flow.pending = flow.pending[:0]
+	}
+
+	if !frame.fin {
+		flow.pending = append(flow.pending, payload...)
+		return
+	}
+
+	t.wsOpcode = flow.opcode
+	t.wsPayload = append(append([]byte(nil), flow.pending...), payload...)
+	flow.pending = nil
+	t.complete = true
+}
+
+// wsBytes returns the unmasked, reassembled payload of a completed
+// WebSocket message, prefixed with a synthetic header line naming the
+// opcode, so downstream outputs can re-frame it without re-parsing the
+// original (possibly masked, possibly fragmented) bytes.
+func (t *TCPMessage) wsBytes() []byte {
+	if !t.complete {
+		return t.rawBytes()
+	}
+
+	header := []byte(fmt.Sprintf("WS-Opcode: %d\r\n\r\n", t.wsOpcode))
+
+	return append(header, t.wsPayload...)
+}
@@ -0,0 +1,93 @@
+package rawSocket
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseWSFrameShortHeader(t *testing.T) {
+	frame, ok := parseWSFrame([]byte{0x81, 0x05, 'h', 'e', 'l'})
+	if !ok {
+		t.Fatalf("expected a 2-byte header with 5-byte length to parse")
+	}
+	if !frame.fin || frame.opcode != wsOpText || frame.headerLen != 2 || frame.payloadLen != 5 {
+		t.Fatalf("unexpected frame: %+v", frame)
+	}
+}
+
+func TestIsUpgradedSymmetricAcrossDirections(t *testing.T) {
+	reqPkt := &TCPPacket{
+		Addr: []byte{10, 0, 0, 1, 10, 0, 0, 2},
+		Raw:  []byte{0x13, 0x88, 0x00, 0x50},
+	}
+	respPkt := &TCPPacket{
+		Addr: []byte{10, 0, 0, 2, 10, 0, 0, 1},
+		Raw:  []byte{0x00, 0x50, 0x13, 0x88},
+	}
+
+	key := flowKey(respPkt)
+	markUpgraded(key)
+
+	if !isUpgraded(flowKey(reqPkt)) {
+		t.Fatalf("a flow marked upgraded from the response side must also read as upgraded from the request side")
+	}
+}
+
+func TestCheckIfCompleteWSReassemblesContinuationFrames(t *testing.T) {
+	key := tcpFlowKey{a: tcpEndpoint{1}, b: tcpEndpoint{2}}
+	delete(wsFlows, wsFlowKey{flow: key, incoming: true})
+	delete(wsFlows, wsFlowKey{flow: key, incoming: false})
+
+	// First fragment: text frame, FIN=0, payload "hel"
+	first := &TCPMessage{packets: []*TCPPacket{{Data: []byte{0x01, 0x03, 'h', 'e', 'l'}}}, IsIncoming: true}
+	first.checkIfCompleteWS(key)
+	if first.complete {
+		t.Fatalf("a frame with FIN=0 must not complete the message")
+	}
+
+	// Final fragment: continuation frame, FIN=1, payload "lo"
+	second := &TCPMessage{packets: []*TCPPacket{{Data: []byte{0x80, 0x02, 'l', 'o'}}}, IsIncoming: true}
+	second.checkIfCompleteWS(key)
+	if !second.complete {
+		t.Fatalf("a FIN=1 continuation frame should complete the reassembled message")
+	}
+	if second.wsOpcode != wsOpText {
+		t.Fatalf("reassembled message should keep the opcode of the first fragment, got %d", second.wsOpcode)
+	}
+	if !bytes.Equal(second.wsPayload, []byte("hello")) {
+		t.Fatalf("expected reassembled payload %q, got %q", "hello", second.wsPayload)
+	}
+}
+
+// TestCheckIfCompleteWSKeepsDirectionsIndependent is the duplex regression
+// test: a fragmented message in flight on one direction must not clobber
+// a concurrently fragmented message in flight on the other direction of
+// the same connection.
+func TestCheckIfCompleteWSKeepsDirectionsIndependent(t *testing.T) {
+	key := tcpFlowKey{a: tcpEndpoint{3}, b: tcpEndpoint{4}}
+	delete(wsFlows, wsFlowKey{flow: key, incoming: true})
+	delete(wsFlows, wsFlowKey{flow: key, incoming: false})
+
+	// Client->server: first fragment of a text message, "foo".
+	reqFirst := &TCPMessage{packets: []*TCPPacket{{Data: []byte{0x01, 0x03, 'f', 'o', 'o'}}}, IsIncoming: true}
+	reqFirst.checkIfCompleteWS(key)
+
+	// Server->client: first fragment of a different text message, "bar",
+	// interleaved before the client->server message finishes.
+	respFirst := &TCPMessage{packets: []*TCPPacket{{Data: []byte{0x01, 0x03, 'b', 'a', 'r'}}}, IsIncoming: false}
+	respFirst.checkIfCompleteWS(key)
+
+	// Client->server: final fragment, "baz".
+	reqLast := &TCPMessage{packets: []*TCPPacket{{Data: []byte{0x80, 0x03, 'b', 'a', 'z'}}}, IsIncoming: true}
+	reqLast.checkIfCompleteWS(key)
+	if !reqLast.complete || !bytes.Equal(reqLast.wsPayload, []byte("foobaz")) {
+		t.Fatalf("expected client->server reassembly %q, got complete=%v payload=%q", "foobaz", reqLast.complete, reqLast.wsPayload)
+	}
+
+	// Server->client: final fragment, "baz".
+	respLast := &TCPMessage{packets: []*TCPPacket{{Data: []byte{0x80, 0x03, 'b', 'a', 'z'}}}, IsIncoming: false}
+	respLast.checkIfCompleteWS(key)
+	if !respLast.complete || !bytes.Equal(respLast.wsPayload, []byte("barbaz")) {
+		t.Fatalf("expected server->client reassembly %q, got complete=%v payload=%q", "barbaz", respLast.complete, respLast.wsPayload)
+	}
+}